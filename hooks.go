@@ -0,0 +1,48 @@
+package pgdb
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Hooks lets callers observe and gate a RunMigrations batch: emit a span per
+// migration, refuse to run a specific version in production without an env
+// var, VACUUM ANALYZE new tables, warm caches, send a Slack notification,
+// and the like.
+//
+// BeforeMigration and AfterMigration receive the in-flight *sqlx.Tx so
+// callers can insert their own audit rows in the same transaction as the
+// db_version/db_version_history updates. An error returned from BeforeAll
+// aborts the run before anything is applied; one returned from
+// BeforeMigration aborts the run at that migration, before its up script is
+// executed, leaving earlier migrations of the batch applied.
+type Hooks struct {
+	// BeforeAll runs once, before the first migration in the batch is
+	// applied. Returning an error aborts the run without applying anything.
+	BeforeAll func(ctx context.Context, migrations []Migration) error
+
+	// BeforeMigration runs inside the same transaction that marks a
+	// migration started, before its up script is executed. Returning an
+	// error rolls back that transaction and ends the run; the remaining
+	// migrations in the batch are not applied.
+	BeforeMigration func(ctx context.Context, tx *sqlx.Tx, migration Migration) error
+
+	// AfterMigration runs inside the same transaction that marks a
+	// migration complete, after its up script has been applied. Returning
+	// an error rolls back that transaction, undoing the completion record.
+	AfterMigration func(ctx context.Context, tx *sqlx.Tx, migration Migration) error
+
+	// OnMigrationError is called whenever a step in the batch fails --
+	// BeforeMigration, the migration's own SQL, AfterMigration, or the
+	// bookkeeping around them -- with the error that occurred. Its return
+	// value replaces that error, so it can annotate or rewrap it (e.g. to
+	// include a Slack notification's own failure) before RunMigrations
+	// returns it.
+	OnMigrationError func(ctx context.Context, migration Migration, err error) error
+
+	// AfterAll runs once the batch has finished, successfully or not, with
+	// the MigrationStatus accumulated so far. If RunMigrations would
+	// otherwise return a nil error, an error returned here takes its place.
+	AfterAll func(ctx context.Context, status MigrationStatus) error
+}
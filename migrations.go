@@ -1,16 +1,13 @@
 package pgdb
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
-	"database/sql"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +15,63 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// migrationUpMarker and migrationDownMarker delimit the up/down halves of a
+// migration that packs both directions into a single numbered file, e.g.
+//
+//	-- +migration Up
+//	CREATE TABLE widgets (id bigserial primary key);
+//	-- +migration Down
+//	DROP TABLE widgets;
+const (
+	migrationUpMarker   = "-- +migration Up"
+	migrationDownMarker = "-- +migration Down"
+)
+
+// ErrIrreversibleMigration is returned by RollbackMigrations when it would
+// need to roll past a migration that has no down script, and the caller did
+// not pass force.
+var ErrIrreversibleMigration = errors.New("pgdb: migration has no down script; pass force to roll past it")
+
+// ErrMigrationLocked is returned by RunMigrations when the migration
+// advisory lock could not be acquired within Config.LockTimeout, meaning
+// another instance is already migrating.
+var ErrMigrationLocked = errors.New("pgdb: could not acquire migration advisory lock")
+
+const defaultLockNamespace = "pgdb_migrations"
+
+// migrationLockKey derives the deterministic bigint key used for
+// pg_advisory_lock from the database's configured lock namespace.
+func (d *Database) migrationLockKey() int64 {
+	namespace := d.lockNamespace
+	if namespace == "" {
+		namespace = defaultLockNamespace
+	}
+
+	sum := md5.Sum([]byte(namespace))
+	return int64(binary.BigEndian.Uint64(sum[:8]))
+}
+
+// Direction describes which way a set of migrations is about to move the
+// database.
+type Direction int
+
+const (
+	DirectionNone Direction = iota
+	DirectionUp
+	DirectionDown
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionUp:
+		return "up"
+	case DirectionDown:
+		return "down"
+	default:
+		return "none"
+	}
+}
+
 type Migration struct {
 	ID       string    `db:"id"`
 	File     string    `db:"file"`
@@ -25,142 +79,371 @@ type Migration struct {
 	Version  uint64    `db:"version"`
 	Complete bool      `db:"complete"`
 	LastRun  time.Time `db:"last_run"`
+
+	// DownFile is the path to the paired down-script for this migration, if
+	// one was discovered on disk. It is empty when the migration only packs
+	// an up block, or has no down block at all.
+	DownFile string `db:"-"`
+
+	// Reversible reports whether a down script (paired file or fenced
+	// section) was found for this migration.
+	Reversible bool `db:"-"`
 }
 
 type MigrationStatus struct {
-	Applied uint64
-	Failed  uint64
-	Skipped uint64
-	Latest  uint64
+	Applied  uint64
+	Failed   uint64
+	Skipped  uint64
+	Reverted uint64
+	Latest   uint64
 }
 
-func (d *Database) GetCurrentMigration() (Migration, error) {
-	migration := Migration{}
-	err := d.View(context.Background(), func(tx *sqlx.Tx) error {
-		err := tx.Get(&migration, "SELECT * FROM db_version WHERE id = '1' LIMIT 1")
-		if err != nil {
-			if err == sql.ErrNoRows {
-				return err
-			}
-
-			return fmt.Errorf("failed to fetch current migration status: %s", err.Error())
-		}
+// MigrationHistory records a single applied migration in db_version_history,
+// which is kept alongside db_version so RollbackMigrations can reconstruct
+// which up/down files were used without re-walking the migration directory.
+type MigrationHistory struct {
+	Version    uint64    `db:"version"`
+	File       string    `db:"file"`
+	DownFile   string    `db:"down_file"`
+	Hash       string    `db:"hash"`
+	Reversible bool      `db:"reversible"`
+	AppliedAt  time.Time `db:"applied_at"`
+	Reverted   bool      `db:"reverted"`
+}
 
-		return nil
-	})
+// GetCurrentMigration returns the database's current migration status from
+// its configured MigrationStore.
+func (d *Database) GetCurrentMigration() (Migration, error) {
+	return d.store.Current(context.Background())
+}
 
-	return migration, err
+// migrationHistory returns every row of migration history, ordered by
+// version ascending.
+func (d *Database) migrationHistory() ([]MigrationHistory, error) {
+	return d.store.History(context.Background())
 }
 
-func (d *Database) DiffMigrations() ([]Migration, error) {
+// DiffMigrations lists every migration known to the configured
+// MigrationSource and reports which of them are still pending, along with
+// the direction applying them would move the database.
+func (d *Database) DiffMigrations() ([]Migration, Direction, error) {
 	currentMigration, err := d.GetCurrentMigration()
 	if err != nil {
-		return nil, err
+		return nil, DirectionNone, err
 	}
 
 	if !currentMigration.Complete {
-		return nil, fmt.Errorf(
+		return nil, DirectionNone, fmt.Errorf(
 			"migration %d in file %s appears to have failed, please rectify manually",
 			currentMigration.Version, currentMigration.File,
 		)
 	}
 
-	migrations := make([]Migration, 0)
-	err = filepath.Walk(d.migrationDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		if filepath.Ext(path) != ".sql" {
-			return nil
-		}
+	if d.source == nil {
+		return nil, DirectionNone, errors.New("no migration source configured")
+	}
 
-		version, err := strconv.ParseInt(strings.Replace(info.Name(), ".sql", "", -1), 10, 64)
-		if err != nil {
-			return err
-		}
+	refs, err := d.source.List()
+	if err != nil {
+		return nil, DirectionNone, err
+	}
 
-		bytes, err := ioutil.ReadFile(path)
+	migrations := make([]Migration, 0, len(refs))
+	for _, ref := range refs {
+		hash, err := d.source.Hash(ref)
 		if err != nil {
-			return err
+			return nil, DirectionNone, err
 		}
 
 		migration := Migration{
-			File:     path,
-			Hash:     fmt.Sprintf("%x", md5.Sum(bytes)),
-			Version:  uint64(version),
-			Complete: uint64(version) <= currentMigration.Version,
+			File:       ref.UpPath,
+			DownFile:   ref.DownPath,
+			Hash:       hash,
+			Version:    ref.Version,
+			Reversible: ref.Reversible,
+			Complete:   ref.Version <= currentMigration.Version,
 		}
 
 		// comment this business out if you need to manually rectify mismatch in dev
 		if migration.Version == currentMigration.Version && migration.Hash != currentMigration.Hash {
-			return errors.New("migrations are up to date but appear to have been modified (latest hash mismatch)")
+			return nil, DirectionNone, errors.New("migrations are up to date but appear to have been modified (latest hash mismatch)")
 		}
 
 		migrations = append(migrations, migration)
-		return nil
-	})
+	}
+
+	sort.Sort(MigrationSet(migrations))
+
+	direction := DirectionNone
+	for _, migration := range migrations {
+		if !migration.Complete {
+			direction = DirectionUp
+			break
+		}
+	}
 
-	return migrations, err
+	return migrations, direction, nil
 }
 
+// RunMigrations applies the given migrations in version order, holding a
+// session-level Postgres advisory lock for the duration of the run so that
+// multiple instances starting at the same time (a common scenario in
+// Kubernetes deployments) can't race each other and half-apply a migration.
+// If the lock can't be acquired within Config.LockTimeout, it returns
+// ErrMigrationLocked.
 func (d *Database) RunMigrations(logger zerolog.Logger, currentMigration Migration, migrations ...Migration) (MigrationStatus, error) {
+	ctx := context.Background()
+
+	conn, err := d.client.Conn(ctx)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	defer conn.Close()
+
+	if d.lockTimeout > 0 {
+		_, err := conn.ExecContext(ctx, fmt.Sprintf("SET lock_timeout = %d", d.lockTimeout.Milliseconds()))
+		if err != nil {
+			return MigrationStatus{}, err
+		}
+	}
+
+	lockKey := d.migrationLockKey()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return MigrationStatus{}, fmt.Errorf("%w: %s", ErrMigrationLocked, err.Error())
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	return d.runMigrationsLocked(logger, currentMigration, migrations...)
+}
+
+// runMigrationsLocked is the body of RunMigrations, run while the migration
+// advisory lock is held. Hooks configured on the database are invoked around
+// the batch and each migration within it; see Hooks for details.
+func (d *Database) runMigrationsLocked(logger zerolog.Logger, currentMigration Migration, migrations ...Migration) (status MigrationStatus, err error) {
+	ctx := context.Background()
 	sort.Sort(MigrationSet(migrations))
-	migrationStatus := MigrationStatus{
+	status = MigrationStatus{
 		Latest: currentMigration.Version,
 	}
 
+	if d.hooks.BeforeAll != nil {
+		if err := d.hooks.BeforeAll(ctx, migrations); err != nil {
+			return status, err
+		}
+	}
+
+	if d.hooks.AfterAll != nil {
+		defer func() {
+			if afterErr := d.hooks.AfterAll(ctx, status); afterErr != nil && err == nil {
+				err = afterErr
+			}
+		}()
+	}
+
 	for _, migration := range migrations {
 		if migration.Complete {
 			// if a migration is already complete just skip it
-			migrationStatus.Skipped += 1
+			status.Skipped += 1
 		} else {
-			err := d.Update(context.Background(), func(tx *sqlx.Tx) error {
-				_, err := tx.Exec(
-					"UPDATE db_version SET version = $1, hash = $2, file = $3, last_run = $4, complete = $5 WHERE id = '1'",
-					migration.Version, migration.Hash, migration.File, time.Now(), false,
-				)
-				if err != nil {
-					return fmt.Errorf("failed to open migration step: %s", err.Error())
+			stepErr := d.Update(ctx, func(tx *sqlx.Tx) error {
+				if d.hooks.BeforeMigration != nil {
+					if err := d.hooks.BeforeMigration(ctx, tx, migration); err != nil {
+						return err
+					}
 				}
 
-				return nil
+				return d.store.MarkStarted(tx, migration)
 			})
-			if err != nil {
-				migrationStatus.Failed += 1
+			if stepErr != nil {
+				status.Failed += 1
+				stepErr = d.onMigrationError(ctx, migration, stepErr)
 
-				logger.Error().Err(err).Uint64("version", migration.Version).Str("file", migration.File).Msg("failed to start migration")
-				return migrationStatus, err
+				logger.Error().Err(stepErr).Uint64("version", migration.Version).Str("file", migration.File).Msg("failed to start migration")
+				return status, stepErr
 			}
 
-			err = d.ExecFile(migration.File)
-			if err != nil {
-				migrationStatus.Failed += 1
+			stepErr = d.applyMigrationUp(migration)
+			if stepErr != nil {
+				status.Failed += 1
+				stepErr = d.onMigrationError(ctx, migration, stepErr)
 
-				logger.Error().Err(err).Uint64("version", migration.Version).Str("file", migration.File).Msg("failed to apply migration")
-				return migrationStatus, err
+				logger.Error().Err(stepErr).Uint64("version", migration.Version).Str("file", migration.File).Msg("failed to apply migration")
+				return status, stepErr
 			}
 
-			err = d.Update(context.Background(), func(tx *sqlx.Tx) error {
-				_, err := tx.Exec("UPDATE db_version SET complete = $1 WHERE id = '1' AND version = $2", true, migration.Version)
-				return err
+			stepErr = d.Update(ctx, func(tx *sqlx.Tx) error {
+				if err := d.store.MarkComplete(tx, migration); err != nil {
+					return err
+				}
+
+				if d.hooks.AfterMigration != nil {
+					return d.hooks.AfterMigration(ctx, tx, migration)
+				}
+
+				return nil
 			})
-			if err != nil {
-				migrationStatus.Failed += 1
+			if stepErr != nil {
+				status.Failed += 1
+				stepErr = d.onMigrationError(ctx, migration, stepErr)
+
+				logger.Error().Err(stepErr).Uint64("version", migration.Version).Str("file", migration.File).Msg("failed to complete migration")
+				return status, stepErr
+			}
+
+			status.Applied += 1
+			status.Latest = migration.Version
+
+		}
+	}
+
+	return status, nil
+}
+
+// onMigrationError passes err through the configured OnMigrationError hook,
+// if any, returning its replacement; otherwise it returns err unchanged.
+func (d *Database) onMigrationError(ctx context.Context, migration Migration, err error) error {
+	if d.hooks.OnMigrationError == nil {
+		return err
+	}
+
+	return d.hooks.OnMigrationError(ctx, migration, err)
+}
+
+// RollbackMigrations walks db_version_history backwards from the current
+// version down to (but not including) target, running the down script
+// recorded for each applied version and updating db_version in the same
+// transaction as that script, so a crash mid-rollback leaves the database
+// at a known version: either the step never happened, or it's fully
+// recorded.
+//
+// If a version in that range has no down script, RollbackMigrations refuses
+// to proceed unless force is true, in which case that version is skipped
+// entirely: its down script is not run, and db_version/db_version_history
+// are left exactly as they were, with the migration still marked applied.
+func (d *Database) RollbackMigrations(logger zerolog.Logger, target uint64, force bool) (MigrationStatus, error) {
+	status := MigrationStatus{}
+
+	history, err := d.migrationHistory()
+	if err != nil {
+		return status, err
+	}
+
+	previousByVersion := make(map[uint64]MigrationHistory, len(history))
+	for _, entry := range history {
+		previousByVersion[entry.Version] = entry
+	}
+
+	// walk from the newest applied version down to target+1
+	for i := len(history) - 1; i >= 0; i-- {
+		entry := history[i]
+		if entry.Reverted || entry.Version <= target {
+			continue
+		}
+
+		if !entry.Reversible {
+			if !force {
+				return status, fmt.Errorf("%w: version %d (%s)", ErrIrreversibleMigration, entry.Version, entry.File)
+			}
 
-				logger.Error().Err(err).Uint64("version", migration.Version).Str("file", migration.File).Msg("failed to complete migration")
-				return migrationStatus, err
+			logger.Warn().Uint64("version", entry.Version).Str("file", entry.File).Msg("forcing rollback past irreversible migration; leaving it marked as applied")
+			continue
+		}
+
+		previous, hasPrevious := previousByVersion[entry.Version-1]
+		newCurrent := Migration{Version: entry.Version - 1}
+		if hasPrevious {
+			newCurrent.Hash = previous.Hash
+			newCurrent.File = previous.File
+		}
+
+		migration := Migration{File: entry.File, DownFile: entry.DownFile, Version: entry.Version, Reversible: entry.Reversible}
+		err := d.Update(context.Background(), func(tx *sqlx.Tx) error {
+			if err := d.applyMigrationDownTx(tx, migration); err != nil {
+				return err
 			}
 
-			migrationStatus.Applied += 1
-			migrationStatus.Latest = migration.Version
+			return d.store.MarkReverted(tx, Migration{Version: entry.Version}, newCurrent)
+		})
+		if err != nil {
+			status.Failed += 1
+			logger.Error().Err(err).Uint64("version", entry.Version).Msg("failed to roll back migration")
+			return status, err
+		}
+
+		status.Reverted += 1
+		status.Latest = entry.Version - 1
+	}
+
+	return status, nil
+}
+
+// applyMigrationUp runs the up half of a migration via the database's
+// configured MigrationSource.
+func (d *Database) applyMigrationUp(migration Migration) error {
+	up, _, err := d.readMigration(migration)
+	if err != nil {
+		return err
+	}
+
+	return d.execSQL(string(up))
+}
+
+// applyMigrationDownTx runs the down half of a migration via the database's
+// configured MigrationSource, against tx, so the caller can record the
+// resulting db_version update in the same transaction as the down script.
+func (d *Database) applyMigrationDownTx(tx *sqlx.Tx, migration Migration) error {
+	_, down, err := d.readMigration(migration)
+	if err != nil {
+		return err
+	}
+
+	return d.execSQLTx(tx, string(down))
+}
+
+// readMigration resolves a Migration's up/down SQL through the database's
+// configured MigrationSource.
+func (d *Database) readMigration(migration Migration) (up, down []byte, err error) {
+	if d.source == nil {
+		return nil, nil, errors.New("no migration source configured")
+	}
+
+	return d.source.Read(MigrationRef{
+		UpPath:     migration.File,
+		DownPath:   migration.DownFile,
+		Reversible: migration.Reversible,
+	})
+}
+
+// splitFencedSections scans data line by line for migrationUpMarker and
+// migrationDownMarker, returning the text found after each. A file with no
+// markers has its entire contents returned as up, with an empty down.
+func splitFencedSections(data []byte) (up, down string) {
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+
+	var section int // 0 = before any marker, 1 = in up, 2 = in down
+	var upLines, downLines []string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch strings.TrimSpace(line) {
+		case migrationUpMarker:
+			section = 1
+			continue
+		case migrationDownMarker:
+			section = 2
+			continue
+		}
 
+		switch section {
+		case 0:
+			upLines = append(upLines, line)
+		case 1:
+			upLines = append(upLines, line)
+		case 2:
+			downLines = append(downLines, line)
 		}
 	}
 
-	return migrationStatus, nil
+	return strings.Join(upLines, "\n"), strings.Join(downLines, "\n")
 }
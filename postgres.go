@@ -4,34 +4,114 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/cosmotek/pgdb/sqlparse"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
 type Config struct {
-	User, Password, Host, Port, DatabaseName, MigrationDir string
-	SSLDisabled                                            bool
+	User, Password, Host, Port, DatabaseName string
+	SSLDisabled                              bool
+
+	// MigrationDir is a convenience for the common case of reading
+	// migrations off disk: it is wrapped in os.DirFS and used as
+	// MigrationsFS when MigrationsFS itself is left nil.
+	MigrationDir string
+
+	// MigrationsFS is the filesystem migrations are read from. Set it to
+	// ship migrations compiled into the binary, e.g. with
+	// `//go:embed migrations/*.sql` and an embed.FS, or to use fstest.MapFS
+	// in tests. Takes priority over MigrationDir.
+	MigrationsFS fs.FS
 
 	MaxIdleConns    int
 	MaxOpenConns    int
 	MaxConnLifespan time.Duration
+
+	// LockNamespace identifies the advisory lock RunMigrations holds for the
+	// duration of a migration run, so that multiple application instances
+	// starting simultaneously don't race each other. Defaults to
+	// "pgdb_migrations" when empty; only needs to be set if a single
+	// Postgres server hosts several pgdb-managed databases that should be
+	// able to migrate concurrently.
+	LockNamespace string
+
+	// LockTimeout bounds how long RunMigrations waits to acquire the
+	// migration advisory lock before giving up with ErrMigrationLocked.
+	// Zero means wait indefinitely.
+	LockTimeout time.Duration
+
+	// MultiStatement passes each migration file to a single tx.Exec call
+	// instead of splitting it into individual statements with sqlparse, at
+	// the cost of losing the per-statement error reporting ExecFile
+	// normally gives. It does not lift migrations out of RunMigrations'
+	// surrounding transaction, so statements Postgres refuses to run inside
+	// any transaction block (e.g. CREATE INDEX CONCURRENTLY) still fail
+	// either way; those need their own non-transactional migration path,
+	// which this package doesn't provide yet.
+	MultiStatement bool
+
+	// StatementTimeout, when set, issues `SET LOCAL statement_timeout` once
+	// at the start of each migration file's transaction, which bounds every
+	// statement run in that transaction so a runaway migration can't hang a
+	// deploy forever.
+	StatementTimeout time.Duration
+
+	// Hooks let callers observe and gate a RunMigrations batch. See Hooks
+	// for details.
+	Hooks Hooks
 }
 
 type Database struct {
-	client       *sqlx.DB
-	migrationDir string
+	client           *sqlx.DB
+	migrations       fs.FS
+	source           MigrationSource
+	store            MigrationStore
+	hooks            Hooks
+	lockNamespace    string
+	lockTimeout      time.Duration
+	multiStatement   bool
+	statementTimeout time.Duration
+
+	// user, password, host, port, and sslMode are kept around (rather than
+	// just the dialed *sqlx.DB) so VerifyMigrationSchema can open its own
+	// connections to scratch databases on the same server.
+	user, password, host, port, sslMode string
 }
 
 // DB is an alias to Database (less to type out).
 type DB = Database
 
+// DialOption customizes a Database constructed by Dial, applied after its
+// defaults (an FSSource over MigrationsFS/MigrationDir, and a PgStore) are
+// set up, so each option only needs to override what it cares about.
+type DialOption func(*Database)
+
+// WithSource overrides the MigrationSource used to discover and read
+// migrations, in place of the default FSSource built from
+// Config.MigrationsFS/MigrationDir.
+func WithSource(source MigrationSource) DialOption {
+	return func(d *Database) {
+		d.source = source
+	}
+}
+
+// WithStore overrides the MigrationStore used to track applied migrations,
+// in place of the default PgStore backed by db_version/db_version_history.
+func WithStore(store MigrationStore) DialOption {
+	return func(d *Database) {
+		d.store = store
+	}
+}
+
 // Dial connects to a postgres database using the provided configuration,
 // and creates/updates the migration table `db_version` with the current version.
-func Dial(conf Config) (*Database, error) {
+func Dial(conf Config, opts ...DialOption) (*Database, error) {
 	sslMode := "require"
 	if conf.SSLDisabled {
 		sslMode = "disable"
@@ -67,7 +147,49 @@ func Dial(conf Config) (*Database, error) {
 	db.SetMaxIdleConns(conf.MaxIdleConns)
 	db.SetConnMaxLifetime(conf.MaxConnLifespan)
 
-	_, err = db.Exec(`
+	if err := ensureMigrationTables(db); err != nil {
+		return nil, err
+	}
+
+	migrationsFS := conf.MigrationsFS
+	if migrationsFS == nil && conf.MigrationDir != "" {
+		migrationsFS = os.DirFS(conf.MigrationDir)
+	}
+
+	sqlxClient := sqlx.NewDb(db, "postgres")
+
+	d := &Database{
+		client:           sqlxClient,
+		migrations:       migrationsFS,
+		source:           FSSource{FS: migrationsFS},
+		store:            NewPgStore(sqlxClient),
+		hooks:            conf.Hooks,
+		lockNamespace:    conf.LockNamespace,
+		lockTimeout:      conf.LockTimeout,
+		multiStatement:   conf.MultiStatement,
+		statementTimeout: conf.StatementTimeout,
+		user:             conf.User,
+		password:         conf.Password,
+		host:             conf.Host,
+		port:             conf.Port,
+		sslMode:          sslMode,
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if err := d.seedCurrentMigration(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// ensureMigrationTables creates db_version and db_version_history if they
+// don't already exist.
+func ensureMigrationTables(db *sql.DB) error {
+	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS db_version (
 			id VARCHAR(1),
 			version bigint,
@@ -78,27 +200,57 @@ func Dial(conf Config) (*Database, error) {
 		);
 	`)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	d := &Database{sqlx.NewDb(db, "postgres"), conf.MigrationDir}
-	_, err = d.GetCurrentMigration()
-	if err != nil {
-		if err == sql.ErrNoRows {
-			_, err := db.Exec(`
-				INSERT INTO db_version
-				(id, version, hash, file, last_run, complete) VALUES
-				('1', 0, '', '', NOW(), true);
-			`)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
+	// db_version_history keeps a row per applied migration so
+	// RollbackMigrations can reconstruct which up/down files were used
+	// without re-walking the migration directory.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS db_version_history (
+			version bigint PRIMARY KEY,
+			file VARCHAR(256),
+			down_file VARCHAR(256),
+			hash VARCHAR(256),
+			reversible BOOLEAN,
+			applied_at TIMESTAMPTZ,
+			reverted BOOLEAN
+		);
+	`)
+	return err
+}
+
+// seedCurrentMigration inserts the initial db_version row (version 0) if
+// one isn't already present.
+func (d *Database) seedCurrentMigration() error {
+	_, err := d.GetCurrentMigration()
+	if err == nil {
+		return nil
 	}
 
-	return d, nil
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = d.client.Exec(`
+		INSERT INTO db_version
+		(id, version, hash, file, last_run, complete) VALUES
+		('1', 0, '', '', NOW(), true);
+	`)
+	return err
+}
+
+// WithMigrationsFS overrides the filesystem migrations are read from and
+// returns the database for chaining, e.g.
+//
+//	//go:embed migrations/*.sql
+//	var migrationsFS embed.FS
+//	db, err := pgdb.Dial(conf)
+//	db = db.WithMigrationsFS(migrationsFS)
+func (d *Database) WithMigrationsFS(fsys fs.FS) *Database {
+	d.migrations = fsys
+	d.source = FSSource{FS: fsys}
+	return d
 }
 
 // Ping sends a ping message to the database to check for signs of life.
@@ -139,25 +291,77 @@ func (d *Database) Update(ctx context.Context, callback func(*sqlx.Tx) error) er
 	return d.exec(ctx, callback, false)
 }
 
-// ExecFile parses the SQL blocks within a file and executes them independently
-// from first to last.
-func (d *Database) ExecFile(filepath string) error {
-	bytes, err := ioutil.ReadFile(filepath)
+// ExecFile parses the SQL blocks within a file (read from the database's
+// configured migrations filesystem) and executes them independently from
+// first to last.
+func (d *Database) ExecFile(path string) error {
+	if d.migrations == nil {
+		return fmt.Errorf("no migrations filesystem configured")
+	}
+
+	bytes, err := fs.ReadFile(d.migrations, path)
 	if err != nil {
 		return err
 	}
 
-	// split on the semicolon delimiter
-	blocks := strings.Split(string(bytes), ";")
+	return d.execSQL(string(bytes))
+}
 
+// execSQL parses the SQL blocks within a string and executes them
+// independently from first to last, inside their own transaction. It backs
+// ExecFile and migration application that doesn't need to share a
+// transaction with other bookkeeping.
+func (d *Database) execSQL(sql string) error {
 	return d.Update(context.Background(), func(tx *sqlx.Tx) error {
-		for i, block := range blocks {
-			_, err := tx.Exec(block)
-			if err != nil {
-				return fmt.Errorf("failed to execute block %d of sql file: %s", i, err.Error())
-			}
+		return d.execSQLTx(tx, sql)
+	})
+}
+
+// execSQLTx parses the SQL blocks within a string and executes them
+// independently from first to last, against the given transaction, so the
+// caller can combine them atomically with other statements (e.g.
+// RollbackMigrations recording the version update in the same tx as the
+// down script).
+func (d *Database) execSQLTx(tx *sqlx.Tx, sql string) error {
+	if err := d.setStatementTimeout(tx); err != nil {
+		return err
+	}
+
+	if d.multiStatement {
+		if _, err := tx.Exec(sql); err != nil {
+			return fmt.Errorf("failed to execute sql: %s", err.Error())
 		}
 
 		return nil
-	})
+	}
+
+	blocks, err := sqlparse.Split(sql)
+	if err != nil {
+		return fmt.Errorf("failed to parse sql: %s", err.Error())
+	}
+
+	for i, block := range blocks {
+		if strings.TrimSpace(block) == "" {
+			continue
+		}
+
+		_, err := tx.Exec(block)
+		if err != nil {
+			return fmt.Errorf("failed to execute block %d of sql file: %s", i, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// setStatementTimeout issues SET LOCAL statement_timeout on tx when
+// Config.StatementTimeout was configured, scoping it to the current
+// transaction only.
+func (d *Database) setStatementTimeout(tx *sqlx.Tx) error {
+	if d.statementTimeout <= 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", d.statementTimeout.Milliseconds()))
+	return err
 }
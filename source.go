@@ -0,0 +1,197 @@
+package pgdb
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// upDownFileRegex matches the paired-file naming scheme, e.g. 0001.up.sql / 0001.down.sql.
+var upDownFileRegex = regexp.MustCompile(`^(\d+)\.(up|down)\.sql$`)
+
+// MigrationRef identifies a single migration a MigrationSource has
+// discovered, independent of how it's named on disk. Version is the
+// ordering key RunMigrations sorts and compares against db_version; today's
+// numeric `NNN.sql` scheme uses the number itself, but a source built
+// around timestamp IDs (e.g. `20240115T113000_add_users.sql`, which merge
+// across branches more cleanly than monotonic integers) can derive it from
+// the timestamp instead.
+type MigrationRef struct {
+	ID         string
+	Version    uint64
+	UpPath     string
+	DownPath   string
+	Reversible bool
+}
+
+// MigrationSource discovers migrations and reads their up/down SQL. The
+// default FSSource/DirSource keep today's `NNN[.up|.down].sql` naming and
+// fenced `-- +migration Up`/`-- +migration Down` sections, but any other
+// naming or storage scheme can be swapped in by implementing this
+// interface and passing it to Dial via WithSource.
+type MigrationSource interface {
+	List() ([]MigrationRef, error)
+	Read(ref MigrationRef) (up, down []byte, err error)
+
+	// Hash returns the drift-detection hash for ref, stored in db_version
+	// and compared against on every DiffMigrations call. It must be stable
+	// across releases of the source, since databases already migrated by an
+	// older version of pgdb have the old hash on record; FSSource hashes the
+	// raw up-file bytes rather than anything Read derives from them.
+	Hash(ref MigrationRef) (string, error)
+}
+
+// FSSource is the default MigrationSource, backed by an fs.FS of `.sql`
+// files using either the paired `NNN.up.sql`/`NNN.down.sql` naming or a
+// single `NNN.sql` file with fenced migrationUpMarker/migrationDownMarker
+// sections.
+type FSSource struct {
+	FS fs.FS
+}
+
+// DirSource is a convenience for the common case of reading migrations off
+// disk: it wraps path in os.DirFS.
+func DirSource(path string) FSSource {
+	return FSSource{FS: os.DirFS(path)}
+}
+
+func (s FSSource) List() ([]MigrationRef, error) {
+	if s.FS == nil {
+		return nil, fmt.Errorf("no migrations filesystem configured")
+	}
+
+	type migrationFiles struct {
+		up, down string
+	}
+
+	found := make(map[uint64]*migrationFiles)
+	err := fs.WalkDir(s.FS, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		if filepath.Ext(path) != ".sql" {
+			return nil
+		}
+
+		name := entry.Name()
+		if m := upDownFileRegex.FindStringSubmatch(name); m != nil {
+			version, err := strconv.ParseUint(m[1], 10, 64)
+			if err != nil {
+				return err
+			}
+
+			files := found[version]
+			if files == nil {
+				files = &migrationFiles{}
+				found[version] = files
+			}
+
+			if m[2] == "up" {
+				files.up = path
+			} else {
+				files.down = path
+			}
+
+			return nil
+		}
+
+		version, err := strconv.ParseInt(strings.Replace(name, ".sql", "", -1), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		files := found[uint64(version)]
+		if files == nil {
+			files = &migrationFiles{}
+			found[uint64(version)] = files
+		}
+		files.up = path
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]MigrationRef, 0, len(found))
+	for version, files := range found {
+		if files.up == "" {
+			return nil, fmt.Errorf("migration %d has a down file but no up file", version)
+		}
+
+		reversible := files.down != ""
+		if !reversible {
+			bytes, err := fs.ReadFile(s.FS, files.up)
+			if err != nil {
+				return nil, err
+			}
+
+			_, down := splitFencedSections(bytes)
+			reversible = down != ""
+		}
+
+		refs = append(refs, MigrationRef{
+			ID:         strconv.FormatUint(version, 10),
+			Version:    version,
+			UpPath:     files.up,
+			DownPath:   files.down,
+			Reversible: reversible,
+		})
+	}
+
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Version < refs[j].Version })
+
+	return refs, nil
+}
+
+func (s FSSource) Read(ref MigrationRef) (up, down []byte, err error) {
+	if s.FS == nil {
+		return nil, nil, fmt.Errorf("no migrations filesystem configured")
+	}
+
+	upBytes, err := fs.ReadFile(s.FS, ref.UpPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ref.DownPath != "" {
+		downBytes, err := fs.ReadFile(s.FS, ref.DownPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return upBytes, downBytes, nil
+	}
+
+	upSection, downSection := splitFencedSections(upBytes)
+	return []byte(upSection), []byte(downSection), nil
+}
+
+// Hash hashes the raw bytes of ref's up file. This must stay raw-byte-for-raw-byte
+// with what earlier versions of pgdb hashed (before fenced sections existed),
+// since a database already migrated by one of those versions has that exact
+// hash on record in db_version; hashing anything Read derives from the file
+// (e.g. the trimmed, re-joined up section) would mismatch on every restart.
+func (s FSSource) Hash(ref MigrationRef) (string, error) {
+	if s.FS == nil {
+		return "", fmt.Errorf("no migrations filesystem configured")
+	}
+
+	raw, err := fs.ReadFile(s.FS, ref.UpPath)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", md5.Sum(raw)), nil
+}
@@ -0,0 +1,185 @@
+// Package sqlparse splits a SQL script into its individual statements
+// without being fooled by semicolons that appear inside string literals,
+// quoted identifiers, comments, or dollar-quoted blocks (the PL/pgSQL
+// function body delimiter popularized by goose/sql-migrate migrations,
+// e.g. `CREATE FUNCTION ... AS $$ ... END; $$ LANGUAGE plpgsql;`).
+//
+// A naive strings.Split(sql, ";") corrupts any of the above; Split tracks
+// enough lexical state to only treat a semicolon as a terminator when it
+// appears outside all of them.
+package sqlparse
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type state int
+
+const (
+	stateTop state = iota
+	stateSingleQuote
+	stateDoubleQuote
+	stateLineComment
+	stateBlockComment
+	stateDollarQuote
+)
+
+// Split splits sql into its top-level statements, in order, dropping any
+// whitespace-only statements (including the one trailing the final
+// semicolon). It returns an error if sql ends inside an unterminated
+// string, comment, or dollar-quoted block.
+func Split(sql string) ([]string, error) {
+	runes := []rune(sql)
+	n := len(runes)
+
+	var statements []string
+	var current strings.Builder
+
+	st := stateTop
+	blockCommentDepth := 0
+	dollarTag := ""
+
+	i := 0
+	for i < n {
+		c := runes[i]
+
+		switch st {
+		case stateTop:
+			switch {
+			case c == '\'':
+				current.WriteRune(c)
+				st = stateSingleQuote
+				i++
+			case c == '"':
+				current.WriteRune(c)
+				st = stateDoubleQuote
+				i++
+			case c == '-' && i+1 < n && runes[i+1] == '-':
+				current.WriteString("--")
+				st = stateLineComment
+				i += 2
+			case c == '/' && i+1 < n && runes[i+1] == '*':
+				current.WriteString("/*")
+				st = stateBlockComment
+				blockCommentDepth = 1
+				i += 2
+			case c == '$':
+				if tag, end, ok := dollarQuoteTag(runes, i); ok {
+					current.WriteString(string(runes[i:end]))
+					dollarTag = tag
+					st = stateDollarQuote
+					i = end
+				} else {
+					current.WriteRune(c)
+					i++
+				}
+			case c == ';':
+				if strings.TrimSpace(current.String()) != "" {
+					statements = append(statements, current.String())
+				}
+				current.Reset()
+				i++
+			default:
+				current.WriteRune(c)
+				i++
+			}
+
+		case stateSingleQuote:
+			current.WriteRune(c)
+			if c == '\'' {
+				if i+1 < n && runes[i+1] == '\'' {
+					current.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				st = stateTop
+			}
+			i++
+
+		case stateDoubleQuote:
+			current.WriteRune(c)
+			if c == '"' {
+				if i+1 < n && runes[i+1] == '"' {
+					current.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				st = stateTop
+			}
+			i++
+
+		case stateLineComment:
+			current.WriteRune(c)
+			if c == '\n' {
+				st = stateTop
+			}
+			i++
+
+		case stateBlockComment:
+			if c == '/' && i+1 < n && runes[i+1] == '*' {
+				current.WriteString("/*")
+				blockCommentDepth++
+				i += 2
+				continue
+			}
+			if c == '*' && i+1 < n && runes[i+1] == '/' {
+				current.WriteString("*/")
+				blockCommentDepth--
+				i += 2
+				if blockCommentDepth == 0 {
+					st = stateTop
+				}
+				continue
+			}
+			current.WriteRune(c)
+			i++
+
+		case stateDollarQuote:
+			closeTag := "$" + dollarTag + "$"
+			if c == '$' && strings.HasPrefix(string(runes[i:]), closeTag) {
+				current.WriteString(closeTag)
+				i += len(closeTag)
+				st = stateTop
+				continue
+			}
+			current.WriteRune(c)
+			i++
+		}
+	}
+
+	switch st {
+	case stateSingleQuote:
+		return nil, fmt.Errorf("sqlparse: unterminated string literal")
+	case stateDoubleQuote:
+		return nil, fmt.Errorf("sqlparse: unterminated quoted identifier")
+	case stateBlockComment:
+		return nil, fmt.Errorf("sqlparse: unterminated block comment")
+	case stateDollarQuote:
+		return nil, fmt.Errorf("sqlparse: unterminated dollar-quoted string tagged %q", dollarTag)
+	}
+
+	if strings.TrimSpace(current.String()) != "" {
+		statements = append(statements, current.String())
+	}
+
+	return statements, nil
+}
+
+// dollarQuoteTag reports whether runes[i:] opens a dollar-quoted string
+// ($$ or $tag$, tag made of letters, digits, and underscores), returning
+// the tag and the index just past the opening delimiter.
+func dollarQuoteTag(runes []rune, i int) (tag string, end int, ok bool) {
+	j := i + 1
+	start := j
+	for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+		j++
+	}
+
+	if j < len(runes) && runes[j] == '$' {
+		return string(runes[start:j]), j + 1, true
+	}
+
+	return "", i, false
+}
@@ -0,0 +1,35 @@
+package sqlparse
+
+import "testing"
+
+// FuzzSplit exercises Split against common PL/pgSQL patterns that break a
+// naive strings.Split(sql, ";"): dollar-quoted function bodies, nested
+// block comments, and string/identifier literals containing semicolons.
+func FuzzSplit(f *testing.F) {
+	seeds := []string{
+		"SELECT 1;",
+		"SELECT 1; SELECT 2;",
+		"SELECT 'a;b''c';",
+		`SELECT "weird "" identifier; name";`,
+		"-- a comment; with a semicolon\nSELECT 1;",
+		"/* block /* nested; */ comment */ SELECT 1;",
+		"CREATE FUNCTION foo() RETURNS void AS $$\nBEGIN\n  PERFORM 1;\nEND;\n$$ LANGUAGE plpgsql;",
+		"CREATE FUNCTION bar() RETURNS void AS $body$\nBEGIN\n  INSERT INTO t (a) VALUES ('semi;colon');\nEND;\n$body$ LANGUAGE plpgsql;",
+		"SELECT 'unterminated",
+		"/* unterminated",
+		"SELECT $$unterminated",
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, sql string) {
+		// Split must never panic, and an error (only ever an unterminated
+		// lexical state) must never be accompanied by statements.
+		statements, err := Split(sql)
+		if err != nil && statements != nil {
+			t.Fatalf("Split(%q) returned both an error and statements: %#v", sql, statements)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{
+			name: "simple statements",
+			sql:  "SELECT 1; SELECT 2;",
+			want: []string{"SELECT 1", " SELECT 2"},
+		},
+		{
+			name: "semicolon inside string literal",
+			sql:  "INSERT INTO t (a) VALUES ('semi;colon');",
+			want: []string{"INSERT INTO t (a) VALUES ('semi;colon')"},
+		},
+		{
+			name: "escaped quote inside string literal",
+			sql:  "SELECT 'it''s; fine';",
+			want: []string{"SELECT 'it''s; fine'"},
+		},
+		{
+			name: "semicolon inside quoted identifier",
+			sql:  `SELECT "weird;name" FROM t;`,
+			want: []string{`SELECT "weird;name" FROM t`},
+		},
+		{
+			name: "semicolon inside line comment",
+			sql:  "SELECT 1; -- trailing; comment\nSELECT 2;",
+			want: []string{"SELECT 1", " -- trailing; comment\nSELECT 2"},
+		},
+		{
+			name: "semicolon inside nested block comment",
+			sql:  "/* outer /* inner; */ still a comment */ SELECT 1;",
+			want: []string{"/* outer /* inner; */ still a comment */ SELECT 1"},
+		},
+		{
+			name: "dollar-quoted function body",
+			sql: "CREATE FUNCTION f() RETURNS void AS $$\n" +
+				"BEGIN\n" +
+				"  PERFORM 1;\n" +
+				"END;\n" +
+				"$$ LANGUAGE plpgsql;",
+			want: []string{
+				"CREATE FUNCTION f() RETURNS void AS $$\nBEGIN\n  PERFORM 1;\nEND;\n$$ LANGUAGE plpgsql",
+			},
+		},
+		{
+			name: "tagged dollar-quoted body",
+			sql: "CREATE FUNCTION g() RETURNS void AS $body$\n" +
+				"INSERT INTO t (a) VALUES ('semi;colon');\n" +
+				"$body$ LANGUAGE plpgsql;\n" +
+				"SELECT 1;",
+			want: []string{
+				"CREATE FUNCTION g() RETURNS void AS $body$\nINSERT INTO t (a) VALUES ('semi;colon');\n$body$ LANGUAGE plpgsql",
+				"\nSELECT 1",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Split(tc.sql)
+			if err != nil {
+				t.Fatalf("Split returned error: %s", err)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Split(%q) = %#v, want %#v", tc.sql, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSplitUnterminated(t *testing.T) {
+	cases := []string{
+		"SELECT 'unterminated",
+		`SELECT "unterminated`,
+		"/* unterminated",
+		"SELECT $$unterminated",
+	}
+
+	for _, sql := range cases {
+		if _, err := Split(sql); err == nil {
+			t.Fatalf("Split(%q) = nil error, want an error", sql)
+		}
+	}
+}
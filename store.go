@@ -0,0 +1,102 @@
+package pgdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MigrationStore tracks which migrations have been applied. PgStore, the
+// default, is backed by the db_version/db_version_history tables, but any
+// other bookkeeping scheme can be swapped in by implementing this interface
+// and passing it to Dial via WithStore.
+//
+// MarkStarted and MarkComplete take the in-flight *sqlx.Tx so a store
+// implementation's bookkeeping commits atomically with the BeforeMigration
+// and AfterMigration hooks run in that same transaction. The migration's own
+// up statements run in a separate transaction between the two. MarkReverted
+// shares its transaction with the down script it records.
+type MigrationStore interface {
+	Current(ctx context.Context) (Migration, error)
+	MarkStarted(tx *sqlx.Tx, migration Migration) error
+	MarkComplete(tx *sqlx.Tx, migration Migration) error
+	MarkReverted(tx *sqlx.Tx, migration Migration, newCurrent Migration) error
+	History(ctx context.Context) ([]MigrationHistory, error)
+}
+
+// PgStore is the default MigrationStore, backed by the db_version and
+// db_version_history tables created by ensureMigrationTables.
+type PgStore struct {
+	client *sqlx.DB
+}
+
+// NewPgStore wraps an existing *sqlx.DB as a MigrationStore.
+func NewPgStore(client *sqlx.DB) *PgStore {
+	return &PgStore{client: client}
+}
+
+func (s *PgStore) Current(ctx context.Context) (Migration, error) {
+	migration := Migration{}
+
+	err := s.client.GetContext(ctx, &migration, "SELECT * FROM db_version WHERE id = '1' LIMIT 1")
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return migration, err
+		}
+
+		return migration, fmt.Errorf("failed to fetch current migration status: %s", err.Error())
+	}
+
+	return migration, nil
+}
+
+func (s *PgStore) MarkStarted(tx *sqlx.Tx, migration Migration) error {
+	_, err := tx.Exec(
+		"UPDATE db_version SET version = $1, hash = $2, file = $3, last_run = $4, complete = $5 WHERE id = '1'",
+		migration.Version, migration.Hash, migration.File, time.Now(), false,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to open migration step: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *PgStore) MarkComplete(tx *sqlx.Tx, migration Migration) error {
+	_, err := tx.Exec("UPDATE db_version SET complete = $1 WHERE id = '1' AND version = $2", true, migration.Version)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO db_version_history (version, file, down_file, hash, reversible, applied_at, reverted)
+		 VALUES ($1, $2, $3, $4, $5, $6, false)
+		 ON CONFLICT (version) DO UPDATE SET
+		   file = EXCLUDED.file, down_file = EXCLUDED.down_file, hash = EXCLUDED.hash,
+		   reversible = EXCLUDED.reversible, applied_at = EXCLUDED.applied_at, reverted = false`,
+		migration.Version, migration.File, migration.DownFile, migration.Hash, migration.Reversible, time.Now(),
+	)
+	return err
+}
+
+func (s *PgStore) MarkReverted(tx *sqlx.Tx, migration Migration, newCurrent Migration) error {
+	_, err := tx.Exec("UPDATE db_version_history SET reverted = true WHERE version = $1", migration.Version)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE db_version SET version = $1, hash = $2, file = $3, last_run = $4, complete = true WHERE id = '1'",
+		newCurrent.Version, newCurrent.Hash, newCurrent.File, time.Now(),
+	)
+	return err
+}
+
+func (s *PgStore) History(ctx context.Context) ([]MigrationHistory, error) {
+	history := make([]MigrationHistory, 0)
+	err := s.client.SelectContext(ctx, &history, "SELECT * FROM db_version_history ORDER BY version ASC")
+	return history, err
+}
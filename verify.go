@@ -0,0 +1,329 @@
+package pgdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+// SchemaObject is a single named object captured by a schema dump: a table
+// column, an index, a constraint, or a function.
+type SchemaObject struct {
+	Kind       string
+	Name       string
+	Definition string
+}
+
+// SchemaDiff is the result of comparing the two schema dumps produced by
+// VerifyMigrationSchema.
+type SchemaDiff struct {
+	Added   []SchemaObject
+	Removed []SchemaObject
+	Changed []SchemaObject
+
+	// UnifiedDiff is a line-oriented unified diff of the two normalized
+	// schema dumps, suitable for logging.
+	UnifiedDiff string
+}
+
+// Empty reports whether the two schemas being compared were identical.
+func (d SchemaDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// VerifyMigrationSchema checks that migrating to toVersion in one run and in
+// two runs split at fromVersion yields the same schema. Both paths read the
+// same, current migration files from the configured MigrationSource, so an
+// edit to an already-applied file changes both paths alike and is not
+// reported as a difference.
+//
+// It migrates two scratch databases on the same server to toVersion by
+// different paths: path A applies every migration from genesis straight
+// through to toVersion; path B stops at fromVersion first, then continues
+// on to toVersion as a second runMigrationsLocked call. Their resulting schemas,
+// dumped via information_schema/pg_catalog introspection, are then
+// compared. Both scratch databases are dropped before returning.
+func (d *Database) VerifyMigrationSchema(ctx context.Context, fromVersion, toVersion uint64) (SchemaDiff, error) {
+	migrations, _, err := d.DiffMigrations()
+	if err != nil {
+		return SchemaDiff{}, err
+	}
+
+	schemaA, err := d.dumpSchemaAtVersions(ctx, migrations, toVersion)
+	if err != nil {
+		return SchemaDiff{}, fmt.Errorf("failed to build schema for path A: %s", err.Error())
+	}
+
+	schemaB, err := d.dumpSchemaAtVersions(ctx, migrations, fromVersion, toVersion)
+	if err != nil {
+		return SchemaDiff{}, fmt.Errorf("failed to build schema for path B: %s", err.Error())
+	}
+
+	return diffSchemas(schemaA, schemaB), nil
+}
+
+// dumpSchemaAtVersions creates a scratch database, migrates it to each stop
+// in turn (each stop is a separate runMigrationsLocked call, modeling a deploy
+// that happened in multiple steps), dumps its resulting schema, and drops
+// it before returning.
+func (d *Database) dumpSchemaAtVersions(ctx context.Context, migrations []Migration, stops ...uint64) ([]SchemaObject, error) {
+	name := fmt.Sprintf("pgdb_verify_%d", time.Now().UnixNano())
+
+	if _, err := d.client.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE %s", pgQuoteIdent(name))); err != nil {
+		return nil, fmt.Errorf("failed to create scratch database: %s", err.Error())
+	}
+	defer d.client.ExecContext(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS %s", pgQuoteIdent(name)))
+
+	scratchClient, err := d.dialScratch(name)
+	if err != nil {
+		return nil, err
+	}
+	defer scratchClient.Close()
+
+	if err := ensureMigrationTables(scratchClient.DB); err != nil {
+		return nil, err
+	}
+
+	scratch := &Database{
+		client:        scratchClient,
+		migrations:    d.migrations,
+		source:        d.source,
+		store:         NewPgStore(scratchClient),
+		lockNamespace: d.lockNamespace,
+	}
+	if err := scratch.seedCurrentMigration(); err != nil {
+		return nil, err
+	}
+
+	logger := zerolog.Nop()
+	current := Migration{Version: 0, Complete: true}
+
+	for _, stop := range stops {
+		pending := migrationsBetween(migrations, current.Version, stop)
+
+		status, err := scratch.runMigrationsLocked(logger, current, pending...)
+		if err != nil {
+			return nil, err
+		}
+
+		current.Version = status.Latest
+	}
+
+	return dumpSchema(ctx, scratchClient)
+}
+
+// dialScratch opens a connection to another database on the same server d
+// is already connected to.
+func (d *Database) dialScratch(name string) (*sqlx.DB, error) {
+	url := fmt.Sprintf(
+		"user=%s password=%s host=%s port=%s dbname=%s sslmode=%s",
+		d.user, d.password, d.host, d.port, name, d.sslMode,
+	)
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlx.NewDb(db, "postgres"), nil
+}
+
+// migrationsBetween returns the migrations with version in (after, through].
+func migrationsBetween(migrations []Migration, after, through uint64) []Migration {
+	selected := make([]Migration, 0)
+	for _, migration := range migrations {
+		if migration.Version > after && migration.Version <= through {
+			migration.Complete = false
+			selected = append(selected, migration)
+		}
+	}
+
+	return selected
+}
+
+// pgQuoteIdent quotes name as a Postgres identifier. Names passed to it in
+// this file are always generated internally, never user input.
+func pgQuoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// dumpSchema introspects db and returns a sorted, normalized list of its
+// columns, indexes, constraints, and functions -- stable enough to diff
+// reliably across two otherwise-identical databases.
+func dumpSchema(ctx context.Context, db *sqlx.DB) ([]SchemaObject, error) {
+	objects := make([]SchemaObject, 0)
+
+	columns := make([]struct {
+		Table    string `db:"table_name"`
+		Column   string `db:"column_name"`
+		DataType string `db:"data_type"`
+		Nullable string `db:"is_nullable"`
+	}, 0)
+	err := db.SelectContext(ctx, &columns, `
+		SELECT table_name, column_name, data_type, is_nullable
+		FROM information_schema.columns
+		WHERE table_schema = 'public'
+		ORDER BY table_name, column_name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump columns: %s", err.Error())
+	}
+	for _, c := range columns {
+		objects = append(objects, SchemaObject{
+			Kind:       "column",
+			Name:       fmt.Sprintf("%s.%s", c.Table, c.Column),
+			Definition: fmt.Sprintf("%s nullable=%s", c.DataType, c.Nullable),
+		})
+	}
+
+	indexes := make([]struct {
+		Name string `db:"indexname"`
+		Def  string `db:"indexdef"`
+	}, 0)
+	err = db.SelectContext(ctx, &indexes, `
+		SELECT indexname, indexdef
+		FROM pg_indexes
+		WHERE schemaname = 'public'
+		ORDER BY indexname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump indexes: %s", err.Error())
+	}
+	for _, idx := range indexes {
+		objects = append(objects, SchemaObject{Kind: "index", Name: idx.Name, Definition: idx.Def})
+	}
+
+	constraints := make([]struct {
+		Name string `db:"conname"`
+		Def  string `db:"definition"`
+	}, 0)
+	err = db.SelectContext(ctx, &constraints, `
+		SELECT conname, pg_get_constraintdef(oid) AS definition
+		FROM pg_constraint
+		WHERE connamespace = 'public'::regnamespace
+		ORDER BY conname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump constraints: %s", err.Error())
+	}
+	for _, c := range constraints {
+		objects = append(objects, SchemaObject{Kind: "constraint", Name: c.Name, Definition: c.Def})
+	}
+
+	functions := make([]struct {
+		Name string `db:"proname"`
+		Def  string `db:"definition"`
+	}, 0)
+	err = db.SelectContext(ctx, &functions, `
+		SELECT proname, pg_get_functiondef(oid) AS definition
+		FROM pg_proc
+		WHERE pronamespace = 'public'::regnamespace
+		ORDER BY proname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump functions: %s", err.Error())
+	}
+	for _, f := range functions {
+		objects = append(objects, SchemaObject{Kind: "function", Name: f.Name, Definition: f.Def})
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Kind != objects[j].Kind {
+			return objects[i].Kind < objects[j].Kind
+		}
+		return objects[i].Name < objects[j].Name
+	})
+
+	return objects, nil
+}
+
+// diffSchemas compares two normalized schema dumps produced by dumpSchema.
+func diffSchemas(a, b []SchemaObject) SchemaDiff {
+	byKeyA := make(map[string]SchemaObject, len(a))
+	for _, obj := range a {
+		byKeyA[obj.Kind+"/"+obj.Name] = obj
+	}
+
+	byKeyB := make(map[string]SchemaObject, len(b))
+	for _, obj := range b {
+		byKeyB[obj.Kind+"/"+obj.Name] = obj
+	}
+
+	diff := SchemaDiff{}
+	for key, obj := range byKeyA {
+		if other, ok := byKeyB[key]; !ok {
+			diff.Removed = append(diff.Removed, obj)
+		} else if other.Definition != obj.Definition {
+			diff.Changed = append(diff.Changed, obj)
+		}
+	}
+	for key, obj := range byKeyB {
+		if _, ok := byKeyA[key]; !ok {
+			diff.Added = append(diff.Added, obj)
+		}
+	}
+
+	sortSchemaObjects(diff.Added)
+	sortSchemaObjects(diff.Removed)
+	sortSchemaObjects(diff.Changed)
+
+	diff.UnifiedDiff = unifiedSchemaDiff(a, b)
+
+	return diff
+}
+
+func sortSchemaObjects(objects []SchemaObject) {
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Kind != objects[j].Kind {
+			return objects[i].Kind < objects[j].Kind
+		}
+		return objects[i].Name < objects[j].Name
+	})
+}
+
+// unifiedSchemaDiff renders a through b as a minimal line-oriented unified
+// diff, matching each object's whole "kind name: definition" line so
+// reordering alone never shows up as noise.
+func unifiedSchemaDiff(a, b []SchemaObject) string {
+	toLines := func(objects []SchemaObject) []string {
+		lines := make([]string, len(objects))
+		for i, obj := range objects {
+			lines[i] = fmt.Sprintf("%s %s: %s", obj.Kind, obj.Name, obj.Definition)
+		}
+		return lines
+	}
+
+	linesA := toLines(a)
+	linesB := toLines(b)
+
+	inB := make(map[string]bool, len(linesB))
+	for _, line := range linesB {
+		inB[line] = true
+	}
+
+	inA := make(map[string]bool, len(linesA))
+	for _, line := range linesA {
+		inA[line] = true
+	}
+
+	var out strings.Builder
+	out.WriteString("--- schema A\n+++ schema B\n")
+	for _, line := range linesA {
+		if !inB[line] {
+			out.WriteString("-" + line + "\n")
+		}
+	}
+	for _, line := range linesB {
+		if !inA[line] {
+			out.WriteString("+" + line + "\n")
+		}
+	}
+
+	return out.String()
+}